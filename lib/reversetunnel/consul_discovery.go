@@ -0,0 +1,274 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// consulClusterTagPrefix tags a registered service with the cluster
+	// it fronts, so one service name can carry proxies for many remote
+	// clusters and Watch can filter to just its own.
+	consulClusterTagPrefix = "teleport-cluster:"
+
+	// consulDefaultTTL is used when ConsulPeerDiscoveryConfig.TTL is unset.
+	consulDefaultTTL = 15 * time.Second
+
+	// consulBlockingQueryTimeout bounds how long a single blocking catalog
+	// query waits for a change before Watch issues the next one.
+	consulBlockingQueryTimeout = 5 * time.Minute
+)
+
+// ConsulPeerDiscoveryConfig configures a ConsulPeerDiscovery.
+type ConsulPeerDiscoveryConfig struct {
+	// Client is the Consul API client used to register services and run
+	// catalog queries.
+	Client *consulapi.Client
+
+	// ServiceName is the Consul service name proxies register under.
+	// Multiple clusters can share a ServiceName; they are told apart by
+	// the teleport-cluster:<name> tag.
+	ServiceName string
+
+	// ClusterName is the remote cluster this discovery backend registers
+	// for and populates peers from.
+	ClusterName string
+
+	// TTL is the interval of the TTL health check backing each
+	// registration; Register renews the check every TTL/2 on its own
+	// timer, independent of the reverse tunnel heartbeat, and if it is not
+	// renewed within TTL Consul marks the proxy critical and Watch stops
+	// routing to it. Defaults to consulDefaultTTL.
+	TTL time.Duration
+}
+
+// CheckAndSetDefaults validates the config and fills in defaults.
+func (c *ConsulPeerDiscoveryConfig) CheckAndSetDefaults() error {
+	if c.Client == nil {
+		return trace.BadParameter("ConsulPeerDiscoveryConfig.Client is required")
+	}
+	if c.ServiceName == "" {
+		return trace.BadParameter("ConsulPeerDiscoveryConfig.ServiceName is required")
+	}
+	if c.ClusterName == "" {
+		return trace.BadParameter("ConsulPeerDiscoveryConfig.ClusterName is required")
+	}
+	if c.TTL == 0 {
+		c.TTL = consulDefaultTTL
+	}
+	return nil
+}
+
+// NewConsulPeerDiscovery returns a PeerDiscovery backed by a Consul
+// service catalog: proxies register themselves as instances of
+// ServiceName with a TTL check that Register renews on a timer (not on
+// reverse tunnel heartbeats), and
+// Watch follows blocking queries against the catalog to keep a
+// clusterPeers' peer set in sync without an auth-server round trip.
+func NewConsulPeerDiscovery(cfg ConsulPeerDiscoveryConfig) (*ConsulPeerDiscovery, error) {
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &ConsulPeerDiscovery{
+		ConsulPeerDiscoveryConfig: cfg,
+		known:                     make(map[string]bool),
+		log: log.WithFields(log.Fields{
+			teleport.Component: teleport.ComponentReverseTunnel,
+			teleport.ComponentFields: map[string]string{
+				"cluster":  cfg.ClusterName,
+				"service":  cfg.ServiceName,
+				"discover": "consul",
+			},
+		}),
+	}, nil
+}
+
+// ConsulPeerDiscovery is a PeerDiscovery implementation backed by a
+// Consul service catalog.
+type ConsulPeerDiscovery struct {
+	ConsulPeerDiscoveryConfig
+	log *log.Entry
+
+	// knownMu guards known, the set of peer names this backend has added
+	// to clusterPeers, so reconcile only ever removes peers it added
+	// itself and leaves peers sourced from services.TunnelConnection
+	// (the auth-server-driven path) alone.
+	knownMu sync.Mutex
+	known   map[string]bool
+}
+
+// Register advertises this proxy in the Consul catalog under
+// connInfo.GetProxyAddr(), tagged with the cluster it fronts, and renews
+// its TTL check until ctx is canceled, at which point the registration
+// is removed.
+func (c *ConsulPeerDiscovery) Register(ctx context.Context, connInfo services.TunnelConnection) error {
+	host, portStr, err := net.SplitHostPort(connInfo.GetProxyAddr())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	serviceID := fmt.Sprintf("%v-%v", c.ServiceName, connInfo.GetName())
+	checkID := serviceID + "-ttl"
+
+	reg := &consulapi.AgentServiceRegistration{
+		ID:      serviceID,
+		Name:    c.ServiceName,
+		Address: host,
+		Port:    port,
+		Tags:    []string{consulClusterTagPrefix + c.ClusterName},
+		Check: &consulapi.AgentServiceCheck{
+			CheckID:                        checkID,
+			TTL:                            c.TTL.String(),
+			DeregisterCriticalServiceAfter: (c.TTL * 5).String(),
+		},
+	}
+	if err := c.Client.Agent().ServiceRegister(reg); err != nil {
+		return trace.Wrap(err)
+	}
+	defer func() {
+		if err := c.Client.Agent().ServiceDeregister(serviceID); err != nil {
+			c.log.Warningf("[TUNNEL] failed to deregister %v from consul: %v", serviceID, err)
+		}
+	}()
+
+	ticker := time.NewTicker(c.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.Client.Agent().UpdateTTL(checkID, "teleport reverse tunnel heartbeat", consulapi.HealthPassing); err != nil {
+				c.log.Warningf("[TUNNEL] failed to renew consul TTL check %v: %v", checkID, err)
+			}
+		}
+	}
+}
+
+// Watch polls the Consul catalog for ServiceName using blocking queries,
+// filters to entries tagged for c.ClusterName, and reconciles the result
+// against peers using addPeer/updatePeer/removePeer so the rest of
+// clusterPeers sees Consul-discovered peers exactly like ones driven by
+// services.TunnelConnection from the auth server.
+func (c *ConsulPeerDiscovery) Watch(ctx context.Context, peers *clusterPeers, srv *server) error {
+	var waitIndex uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		queryOpts := (&consulapi.QueryOptions{
+			WaitIndex: waitIndex,
+			WaitTime:  consulBlockingQueryTimeout,
+		}).WithContext(ctx)
+
+		entries, meta, err := c.Client.Health().Service(c.ServiceName, consulClusterTagPrefix+c.ClusterName, true, queryOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.log.Warningf("[TUNNEL] consul catalog watch for %v failed, retrying: %v", c.ServiceName, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		waitIndex = meta.LastIndex
+
+		if err := c.reconcile(peers, srv, entries); err != nil {
+			c.log.Warningf("[TUNNEL] failed to reconcile consul peers for %v: %v", c.ClusterName, err)
+		}
+	}
+}
+
+func (c *ConsulPeerDiscovery) reconcile(peers *clusterPeers, srv *server, entries []*consulapi.ServiceEntry) error {
+	seen := make(map[string]bool, len(entries))
+
+	for _, entry := range entries {
+		proxyAddr := net.JoinHostPort(entry.Service.Address, strconv.Itoa(entry.Service.Port))
+		name := entry.Service.ID
+		seen[name] = true
+
+		connInfo, err := services.NewTunnelConnection(name, services.TunnelConnectionSpecV2{
+			ClusterName:   c.ClusterName,
+			ProxyName:     entry.Service.ID,
+			LastHeartbeat: time.Now(),
+			Type:          services.ProxyTunnel,
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		connInfo.SetProxyAddr(proxyAddr)
+
+		if !peers.updatePeer(connInfo) {
+			peer, err := newClusterPeer(srv, connInfo)
+			if err != nil {
+				c.log.Warningf("[TUNNEL] failed to add consul-discovered peer %v: %v", name, err)
+				continue
+			}
+			peers.addPeer(peer)
+		}
+
+		c.knownMu.Lock()
+		c.known[name] = true
+		c.knownMu.Unlock()
+	}
+
+	c.knownMu.Lock()
+	defer c.knownMu.Unlock()
+	for _, name := range staleKnownPeers(c.known, seen) {
+		peers.removePeerByName(name)
+		delete(c.known, name)
+	}
+	return nil
+}
+
+// staleKnownPeers returns the names present in known but not in seen, i.e.
+// peers this backend previously discovered that are no longer present in
+// the latest catalog query and should be removed from clusterPeers.
+func staleKnownPeers(known, seen map[string]bool) []string {
+	var stale []string
+	for name := range known {
+		if !seen[name] {
+			stale = append(stale, name)
+		}
+	}
+	return stale
+}
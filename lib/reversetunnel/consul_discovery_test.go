@@ -0,0 +1,97 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestConsulPeerDiscoveryConfigCheckAndSetDefaults(t *testing.T) {
+	var cfg ConsulPeerDiscoveryConfig
+	if err := cfg.CheckAndSetDefaults(); err == nil {
+		t.Fatalf("expected an error with no Client set")
+	}
+
+	cfg = ConsulPeerDiscoveryConfig{ServiceName: "teleport-proxy", ClusterName: "leaf"}
+	if err := cfg.CheckAndSetDefaults(); err == nil {
+		t.Fatalf("expected an error with no Client set")
+	}
+
+	cfg = ConsulPeerDiscoveryConfig{Client: &consulapi.Client{}, ClusterName: "leaf"}
+	if err := cfg.CheckAndSetDefaults(); err == nil {
+		t.Fatalf("expected an error with no ServiceName set")
+	}
+
+	cfg = ConsulPeerDiscoveryConfig{Client: &consulapi.Client{}, ServiceName: "teleport-proxy"}
+	if err := cfg.CheckAndSetDefaults(); err == nil {
+		t.Fatalf("expected an error with no ClusterName set")
+	}
+
+	cfg = ConsulPeerDiscoveryConfig{Client: &consulapi.Client{}, ServiceName: "teleport-proxy", ClusterName: "leaf"}
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		t.Fatalf("CheckAndSetDefaults returned an unexpected error: %v", err)
+	}
+	if cfg.TTL != consulDefaultTTL {
+		t.Fatalf("TTL = %v, want the default of %v", cfg.TTL, consulDefaultTTL)
+	}
+
+	cfg.TTL = time.Second
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		t.Fatalf("CheckAndSetDefaults returned an unexpected error: %v", err)
+	}
+	if cfg.TTL != time.Second {
+		t.Fatalf("an explicitly set TTL should not be overwritten, got %v", cfg.TTL)
+	}
+}
+
+func TestStaleKnownPeers(t *testing.T) {
+	known := map[string]bool{"a": true, "b": true, "c": true}
+	seen := map[string]bool{"b": true, "d": true}
+
+	stale := staleKnownPeers(known, seen)
+	sort.Strings(stale)
+
+	want := []string{"a", "c"}
+	if len(stale) != len(want) {
+		t.Fatalf("staleKnownPeers(%v, %v) = %v, want %v", known, seen, stale, want)
+	}
+	for i := range want {
+		if stale[i] != want[i] {
+			t.Fatalf("staleKnownPeers(%v, %v) = %v, want %v", known, seen, stale, want)
+		}
+	}
+}
+
+func TestStaleKnownPeersNoneStale(t *testing.T) {
+	known := map[string]bool{"a": true}
+	seen := map[string]bool{"a": true, "b": true}
+
+	if stale := staleKnownPeers(known, seen); len(stale) != 0 {
+		t.Fatalf("staleKnownPeers(%v, %v) = %v, want none", known, seen, stale)
+	}
+}
+
+func TestStaleKnownPeersEmptyKnown(t *testing.T) {
+	if stale := staleKnownPeers(nil, map[string]bool{"a": true}); len(stale) != 0 {
+		t.Fatalf("staleKnownPeers(nil, ...) = %v, want none", stale)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"context"
+
+	"github.com/gravitational/teleport/lib/services"
+)
+
+// PeerDiscovery is an alternative source of peer topology for a remote
+// cluster's clusterPeers. It is used alongside the existing
+// addPeer/removePeer/updatePeer path, which is driven by polling
+// services.TunnelConnection resources from the auth server: a
+// PeerDiscovery implementation watches some other source of truth (e.g.
+// a service catalog) and feeds it into the same three calls, so the rest
+// of clusterPeers (pickPeer, the breaker, the PeerPicker strategies)
+// doesn't need to know where a peer came from.
+type PeerDiscovery interface {
+	// Watch follows peer changes for the cluster and calls
+	// peers.addPeer/updatePeer/removePeer as they occur. It blocks until
+	// ctx is canceled or an unrecoverable error occurs.
+	Watch(ctx context.Context, peers *clusterPeers, srv *server) error
+
+	// Register advertises this proxy as a peer under connInfo, keeping
+	// the registration alive until ctx is canceled.
+	Register(ctx context.Context, connInfo services.TunnelConnection) error
+}
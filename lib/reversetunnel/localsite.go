@@ -27,13 +27,60 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/srv/forward"
 
 	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+// SessionRecordingMode is a per-cluster policy controlling whether
+// localSite.Dial returns a connection to an in-memory forwarding SSH
+// server (so the session is recorded at the proxy) or dials the
+// destination directly.
+type SessionRecordingMode string
+
+const (
+	// SessionRecordingModeProxy always records at the proxy, regardless
+	// of what's being dialed. This matches the original hard-coded
+	// behavior and remains the default.
+	SessionRecordingModeProxy = SessionRecordingMode(services.RecordAtProxy)
+
+	// SessionRecordingModeNode trusts registered Teleport nodes to
+	// record their own sessions and only falls back to recording at the
+	// proxy for destinations that aren't a registered node (e.g. a raw
+	// OpenSSH host, which can't record for itself).
+	SessionRecordingModeNode = SessionRecordingMode(services.RecordAtNode)
+
+	// SessionRecordingModeOff never records at the proxy; every dial
+	// goes directly to the destination.
+	SessionRecordingModeOff = SessionRecordingMode(services.RecordOff)
+
+	// recordingModeCacheTTL bounds how long a resolved
+	// SessionRecordingMode is reused before localSite.Dial asks
+	// accessPoint for the cluster config again.
+	recordingModeCacheTTL = 10 * time.Second
+)
+
+// dialsByRecordingMode counts localSite.Dial calls, broken down by
+// whether the dial was recorded at the proxy or went direct to the
+// destination.
+var dialsByRecordingMode = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "teleport",
+		Subsystem: "reversetunnel",
+		Name:      "local_site_dials_total",
+		Help:      "Number of localSite.Dial calls, labeled by whether the session was recorded at the proxy or dialed directly.",
+	},
+	[]string{"recording"},
+)
+
+func init() {
+	prometheus.MustRegister(dialsByRecordingMode)
+}
+
 func newlocalSite(srv *server, domainName string, client auth.ClientI) (*localSite, error) {
 	accessPoint, err := srv.newAccessPoint(client, []string{"reverse", domainName})
 	if err != nil {
@@ -76,6 +123,13 @@ type localSite struct {
 	agentChan ssh.Channel
 	//agentReady chan bool
 	hostCertificateCache *hostCertificateCache
+
+	// recordingModeMu guards the cached recording mode below; it is
+	// separate from the site-wide lock held during Dial so resolving the
+	// mode never contends with in-flight dials.
+	recordingModeMu     sync.Mutex
+	recordingMode       SessionRecordingMode
+	recordingModeExpiry time.Time
 }
 
 func (s *localSite) CachingAccessPoint() (auth.AccessPoint, error) {
@@ -108,19 +162,27 @@ func (s *localSite) SetAgent(a agent.Agent, ch ssh.Channel) {
 	s.agentChan = ch
 }
 
-// Dial dials a given host in this site (cluster).
+// Dial dials a given host in this site (cluster). Whether the session is
+// recorded at the proxy or dialed directly is driven by the cluster's
+// SessionRecordingMode (see shouldRecordAtProxy), not a hard-coded
+// policy.
 func (s *localSite) Dial(from net.Addr, to net.Addr) (net.Conn, error) {
 	s.Lock()
 	defer s.Unlock()
 
 	s.log.Debugf("[PROXY] localSite.Dial(from=%v, to=%v)", from, to)
 
-	recordingProxy := true
+	recordAtProxy, err := s.shouldRecordAtProxy(to)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
 
 	// if we are in recording proxy mode, return a connection to a in-memory
 	// server that can forward requests to a remote ssh server (can be teleport
 	// or openssh)
-	if recordingProxy {
+	if recordAtProxy {
+		dialsByRecordingMode.WithLabelValues("proxy").Inc()
+
 		hostCertificate, err := s.hostCertificateCache.get(to.String())
 		if err != nil {
 			return nil, trace.Wrap(err)
@@ -139,9 +201,104 @@ func (s *localSite) Dial(from net.Addr, to net.Addr) (net.Conn, error) {
 		return conn, nil
 	}
 
+	dialsByRecordingMode.WithLabelValues("direct").Inc()
 	return net.Dial(to.Network(), to.String())
 }
 
+// shouldRecordAtProxy decides, for a single dial to "to", whether the
+// session must be recorded at the proxy. In SessionRecordingModeProxy it
+// always does; in SessionRecordingModeOff it never does; in
+// SessionRecordingModeNode it only does so when "to" isn't a registered
+// Teleport node capable of recording its own session (e.g. a raw OpenSSH
+// host, or a Teleport node too old to record at-node - see
+// nodeCanRecordAtNode).
+func (s *localSite) shouldRecordAtProxy(to net.Addr) (bool, error) {
+	mode, err := s.getRecordingMode()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	switch mode {
+	case SessionRecordingModeOff:
+		return false, nil
+	case SessionRecordingModeNode:
+		servers, err := s.accessPoint.GetNodes(defaults.Namespace)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		server, err := findServer(to.String(), servers)
+		if err != nil {
+			// not a registered Teleport node, e.g. a raw OpenSSH host
+			// that can't record a session on its own.
+			return true, nil
+		}
+		return !nodeCanRecordAtNode(server), nil
+	default:
+		return true, nil
+	}
+}
+
+const (
+	// forceProxyRecordingLabel lets a node opt back into at-proxy
+	// recording regardless of its version, e.g. because it's running
+	// with session recording disabled locally.
+	forceProxyRecordingLabel = "teleport.internal/force-proxy-recording"
+
+	// minAtNodeRecordingVersion is the oldest Teleport version able to
+	// record a session at the node; servers older than this need the
+	// proxy to record on their behalf even under SessionRecordingModeNode.
+	minAtNodeRecordingVersion = "2.3.0"
+)
+
+// nodeCanRecordAtNode reports whether server is new enough, and not
+// explicitly opted out via forceProxyRecordingLabel, to be trusted to
+// record its own sessions under SessionRecordingModeNode.
+func nodeCanRecordAtNode(server services.Server) bool {
+	if server.GetAllLabels()[forceProxyRecordingLabel] == "true" {
+		return false
+	}
+
+	version := server.GetTeleportVersion()
+	if version == "" {
+		// unknown version - don't assume it can record itself.
+		return false
+	}
+	cmp, err := compareSemver(version, minAtNodeRecordingVersion)
+	if err != nil {
+		log.Warningf("[PROXY] failed to parse node %v's version %q, assuming it cannot record at node: %v",
+			server.GetHostname(), version, err)
+		return false
+	}
+	return cmp >= 0
+}
+
+// getRecordingMode returns the cluster's SessionRecordingMode, re-reading
+// it from accessPoint's cluster config at most once every
+// recordingModeCacheTTL so Dial doesn't hit the access point on every
+// connection.
+func (s *localSite) getRecordingMode() (SessionRecordingMode, error) {
+	s.recordingModeMu.Lock()
+	if time.Now().Before(s.recordingModeExpiry) {
+		mode := s.recordingMode
+		s.recordingModeMu.Unlock()
+		return mode, nil
+	}
+	s.recordingModeMu.Unlock()
+
+	clusterConfig, err := s.accessPoint.GetClusterConfig()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	mode := SessionRecordingMode(clusterConfig.GetSessionRecording())
+
+	s.recordingModeMu.Lock()
+	s.recordingMode = mode
+	s.recordingModeExpiry = time.Now().Add(recordingModeCacheTTL)
+	s.recordingModeMu.Unlock()
+
+	return mode, nil
+}
+
 func findServer(addr string, servers []services.Server) (services.Server, error) {
 	for i := range servers {
 		srv := servers[i]
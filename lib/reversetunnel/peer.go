@@ -20,6 +20,8 @@ package reversetunnel
 import (
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -33,33 +35,123 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// peerBreakerMaxFailures is the number of consecutive Dial failures,
+	// within peerBreakerWindow, after which a peer is marked unhealthy
+	// and skipped by pickPeer until peerBreakerCooldown elapses.
+	peerBreakerMaxFailures = 3
+
+	// peerBreakerWindow bounds how long a run of failures counts towards
+	// tripping the breaker, measured from the first failure of the run; a
+	// success, or a failure more than this after that first failure,
+	// resets the counter.
+	peerBreakerWindow = 30 * time.Second
+
+	// peerBreakerCooldown is how long a peer is skipped for once its
+	// breaker has tripped.
+	peerBreakerCooldown = 60 * time.Second
+)
+
 func newClusterPeers(clusterName string) *clusterPeers {
 	return &clusterPeers{
 		clusterName: clusterName,
 		peers:       make(map[string]*clusterPeer),
+		picker:      NewPeerPicker(PeerPickerRoundRobin),
+		log: log.WithFields(log.Fields{
+			teleport.Component: teleport.ComponentReverseTunnel,
+			teleport.ComponentFields: map[string]string{
+				"cluster": clusterName,
+				"side":    "server",
+			},
+		}),
 	}
 }
 
 // clusterPeers is a collection of cluster peers to a given cluster
 type clusterPeers struct {
+	mu          sync.RWMutex
 	clusterName string
 	peers       map[string]*clusterPeer
+	picker      PeerPicker
+	log         *log.Entry
+	prober      *peerProber
 }
 
-func (p *clusterPeers) pickPeer() (*clusterPeer, error) {
-	var currentPeer *clusterPeer
+// SetPeerPicker configures the load-balancing strategy used to select
+// among this cluster's peers. It is safe to call at any time, including
+// while dials are in flight.
+func (p *clusterPeers) SetPeerPicker(picker PeerPicker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.picker = picker
+}
+
+// StartProber begins actively health-probing this cluster's peers in the
+// background, until StopProber is called. Calling it more than once is a
+// no-op.
+func (p *clusterPeers) StartProber() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.prober != nil {
+		return
+	}
+	p.prober = startPeerProber(p)
+}
+
+// StopProber halts the background health prober started by StartProber.
+// It is a no-op if the prober was never started.
+func (p *clusterPeers) StopProber() {
+	p.mu.Lock()
+	prober := p.prober
+	p.prober = nil
+	p.mu.Unlock()
+
+	if prober != nil {
+		prober.Stop()
+	}
+}
+
+// allPeers returns every peer currently known to p, healthy or not.
+func (p *clusterPeers) allPeers() []*clusterPeer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	all := make([]*clusterPeer, 0, len(p.peers))
 	for _, peer := range p.peers {
-		if currentPeer == nil || peer.connInfo.GetLastHeartbeat().After(currentPeer.connInfo.GetLastHeartbeat()) {
-			currentPeer = peer
+		all = append(all, peer)
+	}
+	return all
+}
+
+// healthyPeers returns the peers whose circuit breaker currently permits
+// new dials.
+func (p *clusterPeers) healthyPeers() []*clusterPeer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	healthy := make([]*clusterPeer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		if peer.isHealthy() {
+			healthy = append(healthy, peer)
 		}
 	}
-	if currentPeer == nil {
-		return nil, trace.NotFound("no active peers found for %v")
+	return healthy
+}
+
+func (p *clusterPeers) pickPeer() (*clusterPeer, error) {
+	p.mu.RLock()
+	picker := p.picker
+	p.mu.RUnlock()
+
+	healthy := p.healthyPeers()
+	peer, ok := picker.Pick(healthy)
+	if !ok {
+		return nil, trace.NotFound("no active peers found for %v", p.clusterName)
 	}
-	return currentPeer, nil
+	return peer, nil
 }
 
 func (p *clusterPeers) updatePeer(conn services.TunnelConnection) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	peer, ok := p.peers[conn.GetName()]
 	if !ok {
 		return false
@@ -69,11 +161,23 @@ func (p *clusterPeers) updatePeer(conn services.TunnelConnection) bool {
 }
 
 func (p *clusterPeers) addPeer(peer *clusterPeer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.peers[peer.connInfo.GetName()] = peer
 }
 
 func (p *clusterPeers) removePeer(connInfo services.TunnelConnection) {
-	delete(p.peers, connInfo.GetName())
+	p.removePeerByName(connInfo.GetName())
+}
+
+// removePeerByName removes a peer by its connection name. It exists for
+// PeerDiscovery backends (see discovery.go) that track peers disappearing
+// from their own source of truth and so don't always have a full
+// services.TunnelConnection on hand for the removal.
+func (p *clusterPeers) removePeerByName(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, name)
 }
 
 func (p *clusterPeers) CachingAccessPoint() (auth.AccessPoint, error) {
@@ -118,20 +222,66 @@ func (p *clusterPeers) GetLastConnected() time.Time {
 
 // Dial is used to connect a requesting client (say, tsh) to an SSH server
 // located in a remote connected site, the connection goes through the
-// reverse proxy tunnel.
+// reverse proxy tunnel. If the picked peer's Dial fails, the next healthy
+// peer (per the configured PeerPicker) is tried before giving up, so a
+// single dead proxy doesn't fail the whole connection.
 func (p *clusterPeers) Dial(from, to net.Addr) (conn net.Conn, err error) {
-	peer, err := p.pickPeer()
-	if err != nil {
-		return nil, trace.Wrap(err)
+	healthy := p.healthyPeers()
+	if len(healthy) == 0 {
+		return nil, trace.NotFound("no active peers found for %v", p.clusterName)
+	}
+
+	p.mu.RLock()
+	picker := p.picker
+	p.mu.RUnlock()
+
+	remaining := make([]*clusterPeer, len(healthy))
+	copy(remaining, healthy)
+
+	var lastErr error
+	for len(remaining) > 0 {
+		peer, ok := picker.Pick(remaining)
+		if !ok {
+			break
+		}
+		conn, err = peer.Dial(from, to)
+		if err == nil {
+			return conn, nil
+		}
+		p.log.Warningf("[TUNNEL] peer %v failed to dial %v, trying next peer: %v", peer, to, err)
+		lastErr = err
+		remaining = removePeerFromSlice(remaining, peer)
+	}
+	if lastErr == nil {
+		lastErr = trace.NotFound("no active peers found for %v", p.clusterName)
+	}
+	return nil, trace.Wrap(lastErr)
+}
+
+// removePeerFromSlice returns peers with target removed, preserving order.
+func removePeerFromSlice(peers []*clusterPeer, target *clusterPeer) []*clusterPeer {
+	remaining := make([]*clusterPeer, 0, len(peers)-1)
+	for _, peer := range peers {
+		if peer != target {
+			remaining = append(remaining, peer)
+		}
 	}
-	return peer.Dial(from, to)
+	return remaining
 }
 
-// newClusterPeer returns new cluster peer
+// newClusterPeer returns a new cluster peer using the default
+// (ssh-subsystem) transport.
 func newClusterPeer(srv *server, connInfo services.TunnelConnection) (*clusterPeer, error) {
+	return newClusterPeerWithConfig(srv, connInfo, ClusterPeerConfig{})
+}
+
+// newClusterPeerWithConfig returns a new cluster peer that dials its peer
+// proxy using config.Transport (see peer_transport.go).
+func newClusterPeerWithConfig(srv *server, connInfo services.TunnelConnection, config ClusterPeerConfig) (*clusterPeer, error) {
 	clusterPeer := &clusterPeer{
 		srv:      srv,
 		connInfo: connInfo,
+		config:   config,
 		log: log.WithFields(log.Fields{
 			teleport.Component: teleport.ComponentReverseTunnel,
 			teleport.ComponentFields: map[string]string{
@@ -169,6 +319,134 @@ type clusterPeer struct {
 	accessPoint auth.AccessPoint
 	connInfo    services.TunnelConnection
 	srv         *server
+	config      ClusterPeerConfig
+
+	// weight is used by PeerPickerRandomWeighted; it defaults to 1 and
+	// can be adjusted with SetWeight.
+	weight int32
+
+	// outstanding is the number of in-flight dials through this peer,
+	// used by PeerPickerLeastOutstanding.
+	outstanding int64
+
+	// breakerMu guards the passive circuit breaker fields below.
+	breakerMu           sync.Mutex
+	consecutiveFailures int
+	failureWindowStart  time.Time
+	unhealthyUntil      time.Time
+
+	// probeMu guards the active-probe fields below, populated by the
+	// peerProber in peer_prober.go.
+	probeMu                  sync.Mutex
+	lastProbeAt              time.Time
+	lastProbeRTT             time.Duration
+	lastProbeErr             error
+	consecutiveProbeFailures int
+}
+
+// LastProbeAt returns when this peer was last actively probed, or the
+// zero time if it has never been probed.
+func (s *clusterPeer) LastProbeAt() time.Time {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	return s.lastProbeAt
+}
+
+// LastProbeRTT returns the round-trip time of the last active probe,
+// whether or not it succeeded.
+func (s *clusterPeer) LastProbeRTT() time.Duration {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	return s.lastProbeRTT
+}
+
+// LastProbeErr returns the error from the last active probe, or nil if it
+// succeeded or none has run yet.
+func (s *clusterPeer) LastProbeErr() error {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	return s.lastProbeErr
+}
+
+// recordProbe stores the outcome of an active health probe (see
+// peer_prober.go), tracking consecutive failures so isProbeDegraded can
+// require more than one bad probe before affecting GetStatus.
+func (s *clusterPeer) recordProbe(rtt time.Duration, err error) {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	s.lastProbeAt = time.Now()
+	s.lastProbeRTT = rtt
+	s.lastProbeErr = err
+	if err == nil {
+		s.consecutiveProbeFailures = 0
+	} else {
+		s.consecutiveProbeFailures++
+	}
+}
+
+// isProbeDegraded reports whether this peer has failed enough
+// consecutive active probes that GetStatus should report it degraded
+// even though it's still heartbeating.
+func (s *clusterPeer) isProbeDegraded() bool {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	return s.consecutiveProbeFailures >= probeFailureThreshold
+}
+
+// SetWeight sets the weight used by PeerPickerRandomWeighted. Weights
+// below 1 are treated as 1. The active health prober (see peer_prober.go)
+// calls this after every probe to keep weights in sync with observed
+// latency; callers can still call it directly, e.g. in tests.
+func (s *clusterPeer) SetWeight(weight int) {
+	atomic.StoreInt32(&s.weight, int32(weight))
+}
+
+func (s *clusterPeer) getWeight() int {
+	w := int(atomic.LoadInt32(&s.weight))
+	if w < 1 {
+		return 1
+	}
+	return w
+}
+
+func (s *clusterPeer) outstandingConns() int64 {
+	return atomic.LoadInt64(&s.outstanding)
+}
+
+// isHealthy reports whether the peer's circuit breaker currently permits
+// new dials.
+func (s *clusterPeer) isHealthy() bool {
+	s.breakerMu.Lock()
+	defer s.breakerMu.Unlock()
+	return time.Now().After(s.unhealthyUntil)
+}
+
+// recordDialResult feeds a Dial outcome into the breaker. After
+// peerBreakerMaxFailures consecutive failures within peerBreakerWindow,
+// the peer is marked unhealthy until peerBreakerCooldown elapses; any
+// success resets the counter.
+func (s *clusterPeer) recordDialResult(err error) {
+	s.breakerMu.Lock()
+	defer s.breakerMu.Unlock()
+
+	if err == nil {
+		s.consecutiveFailures = 0
+		s.failureWindowStart = time.Time{}
+		s.unhealthyUntil = time.Time{}
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(s.failureWindowStart) > peerBreakerWindow {
+		s.consecutiveFailures = 0
+		s.failureWindowStart = now
+	}
+	s.consecutiveFailures++
+	if s.consecutiveFailures >= peerBreakerMaxFailures {
+		s.unhealthyUntil = now.Add(peerBreakerCooldown)
+		s.log.Warningf("[TUNNEL] peer %v tripped circuit breaker after %v consecutive dial failures, skipping until %v",
+			s.connInfo.GetClusterName(), s.consecutiveFailures, s.unhealthyUntil)
+	}
 }
 
 func (s *clusterPeer) CachingAccessPoint() (auth.AccessPoint, error) {
@@ -183,11 +461,18 @@ func (s *clusterPeer) String() string {
 	return fmt.Sprintf("clusterPeer(%v)", s.connInfo)
 }
 
+// GetStatus reports RemoteSiteStatusOffline once the peer stops
+// heartbeating, and RemoteSiteStatusDegraded if it's still heartbeating
+// but has been failing the active health probe (see peer_prober.go) -
+// i.e. it knows about the cluster but may not be accepting new sessions.
 func (s *clusterPeer) GetStatus() string {
 	diff := time.Now().Sub(s.connInfo.GetLastHeartbeat())
 	if diff > defaults.ReverseTunnelOfflineThreshold {
 		return RemoteSiteStatusOffline
 	}
+	if s.isProbeDegraded() {
+		return RemoteSiteStatusDegraded
+	}
 	return RemoteSiteStatusOnline
 }
 
@@ -201,8 +486,37 @@ func (s *clusterPeer) GetLastConnected() time.Time {
 
 // Dial is used to connect a requesting client (say, tsh) to an SSH server
 // located in a remote connected site, the connection goes through the
-// reverse proxy tunnel.
+// reverse proxy tunnel. Every attempt is recorded in the peer's passive
+// circuit breaker (see recordDialResult), and successful dials are
+// tracked as outstanding until the returned conn is closed, feeding the
+// PeerPicker strategies above.
 func (s *clusterPeer) Dial(from, to net.Addr) (conn net.Conn, err error) {
+	atomic.AddInt64(&s.outstanding, 1)
+	defer func() {
+		s.recordDialResult(err)
+		if err != nil {
+			atomic.AddInt64(&s.outstanding, -1)
+		}
+	}()
+
+	var peerConn net.Conn
+	switch s.config.Transport {
+	case ClusterPeerTransportTLS:
+		peerConn, err = s.dialTLS(from, to)
+	default:
+		peerConn, err = s.dialSSHSubsystem(from, to)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &trackedPeerConn{Conn: peerConn, peer: s}, nil
+}
+
+// dialSSHSubsystem is the original transport: it opens an SSH session to
+// the peer proxy and runs a proxy:<addr>@<cluster> subsystem, tunneling
+// raw bytes through its stdin/stdout.
+func (s *clusterPeer) dialSSHSubsystem(from, to net.Addr) (net.Conn, error) {
 	s.log.Infof("[TUNNEL] forward connection to %v through the peer %v", to, s.connInfo.GetProxyAddr())
 
 	client, err := proxy.DialWithDeadline(to.Network(), s.connInfo.GetProxyAddr(), s.srv.ClientConfig())
@@ -240,3 +554,19 @@ func (s *clusterPeer) Dial(from, to net.Addr) (conn net.Conn, err error) {
 		to,
 	), nil
 }
+
+// trackedPeerConn decrements its owning peer's outstanding dial count the
+// first time it is closed, so PeerPickerLeastOutstanding reflects real
+// in-flight load rather than just successful Dial calls.
+type trackedPeerConn struct {
+	net.Conn
+	peer *clusterPeer
+	once sync.Once
+}
+
+func (c *trackedPeerConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.peer.outstanding, -1)
+	})
+	return c.Conn.Close()
+}
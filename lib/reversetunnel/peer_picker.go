@@ -0,0 +1,180 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PeerPickerStrategy identifies one of the built-in load balancing
+// strategies used by clusterPeers to choose among the peers available
+// for a remote cluster.
+type PeerPickerStrategy string
+
+const (
+	// PeerPickerRoundRobin cycles through healthy peers in order. It is
+	// the default strategy and the closest match to the old
+	// most-recent-heartbeat behavior in terms of spreading load evenly.
+	PeerPickerRoundRobin PeerPickerStrategy = "round-robin"
+
+	// PeerPickerRandomWeighted picks a healthy peer at random, weighted
+	// by each peer's configured weight (see clusterPeer.SetWeight).
+	PeerPickerRandomWeighted PeerPickerStrategy = "random-weighted"
+
+	// PeerPickerLeastOutstanding picks the healthy peer with the fewest
+	// in-flight dials, i.e. the one currently doing the least work.
+	PeerPickerLeastOutstanding PeerPickerStrategy = "least-outstanding"
+
+	// PeerPickerLeastLatency picks the healthy peer with the lowest
+	// round-trip time observed by the active health prober (see
+	// peer_prober.go). Peers that have never been probed, or whose most
+	// recent probe failed, are treated as the slowest, so probed-healthy
+	// peers are preferred.
+	PeerPickerLeastLatency PeerPickerStrategy = "least-latency"
+)
+
+// unprobedLatency is the effective latency assigned to a peer that has
+// never been probed or whose most recent active health probe failed, so
+// PeerPickerLeastLatency still prefers any peer with real data.
+const unprobedLatency = time.Hour
+
+// PeerPicker selects which clusterPeer to try next out of a set of peers
+// that the caller has already narrowed down to the healthy ones.
+// Implementations may keep internal state (such as a round-robin cursor)
+// across calls and must be safe for concurrent use.
+type PeerPicker interface {
+	// Pick returns the peer to dial next out of peers, or false if peers
+	// is empty.
+	Pick(peers []*clusterPeer) (*clusterPeer, bool)
+}
+
+// NewPeerPicker returns the PeerPicker implementation for the given
+// strategy, falling back to PeerPickerRoundRobin for an unrecognized or
+// empty strategy.
+func NewPeerPicker(strategy PeerPickerStrategy) PeerPicker {
+	switch strategy {
+	case PeerPickerRandomWeighted:
+		return newRandomWeightedPicker()
+	case PeerPickerLeastOutstanding:
+		return &leastOutstandingPicker{}
+	case PeerPickerLeastLatency:
+		return &leastLatencyPicker{}
+	default:
+		return &roundRobinPicker{}
+	}
+}
+
+// roundRobinPicker cycles through the supplied peers in order, keeping its
+// cursor between calls so repeated picks spread evenly across the set.
+type roundRobinPicker struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *roundRobinPicker) Pick(peers []*clusterPeer) (*clusterPeer, bool) {
+	if len(peers) == 0 {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peer := peers[p.next%len(peers)]
+	p.next++
+	return peer, true
+}
+
+// randomWeightedPicker picks a peer at random, in proportion to each
+// peer's configured weight.
+type randomWeightedPicker struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newRandomWeightedPicker() *randomWeightedPicker {
+	return &randomWeightedPicker{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p *randomWeightedPicker) Pick(peers []*clusterPeer) (*clusterPeer, bool) {
+	if len(peers) == 0 {
+		return nil, false
+	}
+	total := 0
+	for _, peer := range peers {
+		total += peer.getWeight()
+	}
+	if total <= 0 {
+		return peers[0], true
+	}
+
+	p.mu.Lock()
+	n := p.rng.Intn(total)
+	p.mu.Unlock()
+
+	for _, peer := range peers {
+		n -= peer.getWeight()
+		if n < 0 {
+			return peer, true
+		}
+	}
+	return peers[len(peers)-1], true
+}
+
+// leastOutstandingPicker picks the peer with the fewest in-flight dials,
+// approximating least-connections load balancing.
+type leastOutstandingPicker struct{}
+
+func (p *leastOutstandingPicker) Pick(peers []*clusterPeer) (*clusterPeer, bool) {
+	var best *clusterPeer
+	var bestOutstanding int64
+	for _, peer := range peers {
+		outstanding := peer.outstandingConns()
+		if best == nil || outstanding < bestOutstanding {
+			best = peer
+			bestOutstanding = outstanding
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best, true
+}
+
+// leastLatencyPicker picks the peer with the lowest latency observed by
+// its most recent active health probe; a peer whose most recent probe
+// failed counts as unprobed, whatever its earlier probes measured.
+type leastLatencyPicker struct{}
+
+func (p *leastLatencyPicker) Pick(peers []*clusterPeer) (*clusterPeer, bool) {
+	var best *clusterPeer
+	var bestRTT time.Duration
+	for _, peer := range peers {
+		rtt := peer.LastProbeRTT()
+		if peer.LastProbeErr() != nil || peer.LastProbeAt().IsZero() {
+			rtt = unprobedLatency
+		}
+		if best == nil || rtt < bestRTT {
+			best = peer
+			bestRTT = rtt
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best, true
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewPeerPickerDefaultsToRoundRobin(t *testing.T) {
+	if _, ok := NewPeerPicker("bogus-strategy").(*roundRobinPicker); !ok {
+		t.Fatalf("NewPeerPicker with an unrecognized strategy should fall back to round-robin")
+	}
+	if _, ok := NewPeerPicker("").(*roundRobinPicker); !ok {
+		t.Fatalf("NewPeerPicker with an empty strategy should fall back to round-robin")
+	}
+}
+
+func TestRoundRobinPickerCycles(t *testing.T) {
+	a, b, c := &clusterPeer{}, &clusterPeer{}, &clusterPeer{}
+	peers := []*clusterPeer{a, b, c}
+
+	picker := &roundRobinPicker{}
+	var got []*clusterPeer
+	for i := 0; i < 6; i++ {
+		peer, ok := picker.Pick(peers)
+		if !ok {
+			t.Fatalf("Pick(%d) returned ok=false for a non-empty slice", i)
+		}
+		got = append(got, peer)
+	}
+
+	want := []*clusterPeer{a, b, c, a, b, c}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pick %d = %p, want %p", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRoundRobinPickerEmpty(t *testing.T) {
+	if _, ok := (&roundRobinPicker{}).Pick(nil); ok {
+		t.Fatalf("Pick of an empty slice should return ok=false")
+	}
+}
+
+func TestRandomWeightedPickerPicksFromGivenPeers(t *testing.T) {
+	heavy := &clusterPeer{}
+	heavy.SetWeight(100)
+	light := &clusterPeer{}
+	light.SetWeight(1)
+
+	picker := newRandomWeightedPicker()
+	for i := 0; i < 50; i++ {
+		peer, ok := picker.Pick([]*clusterPeer{light})
+		if !ok || peer != light {
+			t.Fatalf("Pick with a single peer should always return that peer")
+		}
+	}
+
+	// With an overwhelmingly larger weight, heavy should be picked at
+	// least once out of many draws; this only checks that heavy is
+	// reachable, not the distribution of picks across the weights.
+	sawHeavy := false
+	for i := 0; i < 200; i++ {
+		peer, ok := picker.Pick([]*clusterPeer{heavy, light})
+		if !ok {
+			t.Fatalf("Pick returned ok=false for a non-empty slice")
+		}
+		if peer == heavy {
+			sawHeavy = true
+		}
+	}
+	if !sawHeavy {
+		t.Fatalf("expected the heavily-weighted peer to be picked at least once in 200 draws")
+	}
+}
+
+func TestLeastOutstandingPickerPrefersFewestInFlight(t *testing.T) {
+	busy := &clusterPeer{outstanding: 5}
+	idle := &clusterPeer{outstanding: 1}
+
+	peer, ok := (&leastOutstandingPicker{}).Pick([]*clusterPeer{busy, idle})
+	if !ok || peer != idle {
+		t.Fatalf("expected the least-busy peer to be picked")
+	}
+}
+
+func TestLeastLatencyPickerPrefersProbedFasterPeer(t *testing.T) {
+	fast := &clusterPeer{}
+	fast.recordProbe(10*time.Millisecond, nil)
+
+	slow := &clusterPeer{}
+	slow.recordProbe(500*time.Millisecond, nil)
+
+	peer, ok := (&leastLatencyPicker{}).Pick([]*clusterPeer{slow, fast})
+	if !ok || peer != fast {
+		t.Fatalf("expected the lower-RTT peer to be picked")
+	}
+}
+
+func TestLeastLatencyPickerPrefersAnyProbedPeerOverUnprobed(t *testing.T) {
+	unprobed := &clusterPeer{}
+
+	probedButSlow := &clusterPeer{}
+	probedButSlow.recordProbe(2*time.Second, nil)
+
+	peer, ok := (&leastLatencyPicker{}).Pick([]*clusterPeer{unprobed, probedButSlow})
+	if !ok || peer != probedButSlow {
+		t.Fatalf("expected a probed peer to beat an unprobed one, regardless of its RTT")
+	}
+}
+
+func TestLeastLatencyPickerTreatsFailedProbeAsUnprobed(t *testing.T) {
+	failing := &clusterPeer{}
+	failing.recordProbe(time.Millisecond, errors.New("probe failed"))
+
+	healthy := &clusterPeer{}
+	healthy.recordProbe(time.Second, nil)
+
+	peer, ok := (&leastLatencyPicker{}).Pick([]*clusterPeer{failing, healthy})
+	if !ok || peer != healthy {
+		t.Fatalf("a peer whose last probe failed should lose to any peer with a successful probe")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/utils/proxy"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// RemoteSiteStatusDegraded marks a peer that is still heartbeating
+	// (so GetStatus wouldn't otherwise consider it offline) but has
+	// failed enough consecutive active health probes that it may not be
+	// accepting new sessions.
+	RemoteSiteStatusDegraded = "degraded"
+
+	// probeInterval is how often each peer is actively probed.
+	probeInterval = 30 * time.Second
+
+	// probeTimeout bounds how long a probe's keepalive request may take,
+	// once the SSH connection is up, before the probe counts as a
+	// failure; the dial itself is not covered by it.
+	probeTimeout = 10 * time.Second
+
+	// probeFailureThreshold is how many consecutive probe failures it
+	// takes for GetStatus to report a peer as degraded.
+	probeFailureThreshold = 2
+)
+
+var (
+	peerProbeRTTSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "teleport",
+		Subsystem: "reversetunnel",
+		Name:      "peer_probe_rtt_seconds",
+		Help:      "Round-trip time of the last successful active health probe to a cluster peer.",
+	}, []string{"cluster", "peer"})
+
+	peerProbeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "teleport",
+		Subsystem: "reversetunnel",
+		Name:      "peer_probe_success",
+		Help:      "Whether the last active health probe to a cluster peer succeeded (1) or failed (0).",
+	}, []string{"cluster", "peer"})
+)
+
+func init() {
+	prometheus.MustRegister(peerProbeRTTSeconds, peerProbeSuccess)
+}
+
+// peerProber periodically opens a lightweight SSH session to each of a
+// clusterPeers' peers and issues a no-op global request, recording the
+// latency and success of each attempt. This gives GetStatus and the
+// PeerPickerLeastLatency strategy a live signal, rather than relying
+// solely on tunnel heartbeats, which only say a peer is still connected,
+// not that it's still accepting new sessions.
+type peerProber struct {
+	peers  *clusterPeers
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startPeerProber starts probing peers' peers in the background and
+// returns immediately; call Stop to halt it.
+func startPeerProber(peers *clusterPeers) *peerProber {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &peerProber{
+		peers:  peers,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.run(ctx)
+	return p
+}
+
+// Stop halts the prober and waits for its goroutine to exit.
+func (p *peerProber) Stop() {
+	p.cancel()
+	<-p.done
+}
+
+func (p *peerProber) run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.probeAll()
+		}
+	}
+}
+
+func (p *peerProber) probeAll() {
+	for _, peer := range p.peers.allPeers() {
+		go p.probeOne(peer)
+	}
+}
+
+func (p *peerProber) probeOne(peer *clusterPeer) {
+	start := time.Now()
+	err := probePeer(peer)
+	rtt := time.Since(start)
+	peer.recordProbe(rtt, err)
+
+	cluster := peer.connInfo.GetClusterName()
+	name := peer.connInfo.GetName()
+	if err != nil {
+		peer.log.Debugf("[TUNNEL] active health probe of peer %v failed: %v", peer.connInfo.GetProxyAddr(), err)
+		// A peer that's failing probes shouldn't get a larger share of
+		// PeerPickerRandomWeighted traffic just because nothing has
+		// tripped its dial-failure breaker yet.
+		peer.SetWeight(minProbeWeight)
+		peerProbeSuccess.WithLabelValues(cluster, name).Set(0)
+		return
+	}
+	peer.SetWeight(weightFromRTT(rtt))
+	peerProbeRTTSeconds.WithLabelValues(cluster, name).Set(rtt.Seconds())
+	peerProbeSuccess.WithLabelValues(cluster, name).Set(1)
+}
+
+const (
+	// minProbeWeight is the PeerPickerRandomWeighted weight assigned to a
+	// peer that just failed an active probe.
+	minProbeWeight = 1
+
+	// maxProbeWeight caps the weight a single fast peer can reach, so one
+	// very-low-latency peer can't starve the others of all traffic.
+	maxProbeWeight = 100
+)
+
+// weightFromRTT converts a probe round-trip time into a
+// PeerPickerRandomWeighted weight: lower latency earns proportionally
+// more weight, clamped to [minProbeWeight, maxProbeWeight].
+func weightFromRTT(rtt time.Duration) int {
+	if rtt <= 0 {
+		return maxProbeWeight
+	}
+	weight := int(time.Second / rtt)
+	switch {
+	case weight < minProbeWeight:
+		return minProbeWeight
+	case weight > maxProbeWeight:
+		return maxProbeWeight
+	default:
+		return weight
+	}
+}
+
+// probePeer opens a short-lived SSH session to peer's proxy address and
+// issues a no-op keepalive global request. It doesn't go through the
+// proxy: subsystem and doesn't feed peer's dial-failure circuit breaker -
+// it measures whether the peer is responsive, not whether a tunneled
+// dial through it would succeed.
+func probePeer(peer *clusterPeer) error {
+	client, err := proxy.DialWithDeadline(
+		"tcp",
+		peer.connInfo.GetProxyAddr(),
+		peer.srv.ClientConfig(),
+	)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(teleport.KeepAliveReqType, true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return trace.Wrap(err)
+	case <-time.After(probeTimeout):
+		return trace.ConnectionProblem(nil, "probe of %v timed out after %v", peer.connInfo.GetProxyAddr(), probeTimeout)
+	}
+}
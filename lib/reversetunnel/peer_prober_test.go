@@ -0,0 +1,99 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWeightFromRTT(t *testing.T) {
+	tests := []struct {
+		name string
+		rtt  time.Duration
+		want int
+	}{
+		{name: "zero rtt clamps to max", rtt: 0, want: maxProbeWeight},
+		{name: "very fast clamps to max", rtt: time.Microsecond, want: maxProbeWeight},
+		{name: "one second is the unit weight", rtt: time.Second, want: 1},
+		{name: "very slow clamps to min", rtt: time.Hour, want: minProbeWeight},
+		{name: "100ms gives a weight of 10", rtt: 100 * time.Millisecond, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := weightFromRTT(tt.rtt); got != tt.want {
+				t.Fatalf("weightFromRTT(%v) = %d, want %d", tt.rtt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsProbeDegradedRequiresConsecutiveFailures(t *testing.T) {
+	peer := &clusterPeer{}
+	if peer.isProbeDegraded() {
+		t.Fatalf("a peer that has never been probed should not be degraded")
+	}
+
+	peer.recordProbe(time.Millisecond, errors.New("probe failed"))
+	if probeFailureThreshold <= 1 {
+		t.Fatalf("test assumes probeFailureThreshold > 1, got %d", probeFailureThreshold)
+	}
+	if peer.isProbeDegraded() {
+		t.Fatalf("a single probe failure should not mark the peer degraded when the threshold is %d", probeFailureThreshold)
+	}
+
+	for i := 1; i < probeFailureThreshold; i++ {
+		peer.recordProbe(time.Millisecond, errors.New("probe failed"))
+	}
+	if !peer.isProbeDegraded() {
+		t.Fatalf("%d consecutive probe failures should mark the peer degraded", probeFailureThreshold)
+	}
+}
+
+func TestIsProbeDegradedResetsOnSuccess(t *testing.T) {
+	peer := &clusterPeer{}
+	for i := 0; i < probeFailureThreshold; i++ {
+		peer.recordProbe(time.Millisecond, errors.New("probe failed"))
+	}
+	if !peer.isProbeDegraded() {
+		t.Fatalf("expected the peer to be degraded after %d consecutive failures", probeFailureThreshold)
+	}
+
+	peer.recordProbe(time.Millisecond, nil)
+	if peer.isProbeDegraded() {
+		t.Fatalf("a successful probe should clear the degraded state")
+	}
+}
+
+func TestRecordProbeStoresLastResult(t *testing.T) {
+	peer := &clusterPeer{}
+	probeErr := errors.New("probe failed")
+	peer.recordProbe(42*time.Millisecond, probeErr)
+
+	if peer.LastProbeRTT() != 42*time.Millisecond {
+		t.Fatalf("LastProbeRTT() = %v, want 42ms", peer.LastProbeRTT())
+	}
+	if peer.LastProbeErr() != probeErr {
+		t.Fatalf("LastProbeErr() = %v, want %v", peer.LastProbeErr(), probeErr)
+	}
+	if peer.LastProbeAt().IsZero() {
+		t.Fatalf("LastProbeAt() should be set after a probe")
+	}
+}
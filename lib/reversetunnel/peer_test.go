@@ -0,0 +1,119 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClusterPeerHealthyByDefault(t *testing.T) {
+	peer := &clusterPeer{}
+	if !peer.isHealthy() {
+		t.Fatalf("a freshly created peer should be healthy")
+	}
+}
+
+func TestRecordDialResultBelowThresholdStaysHealthy(t *testing.T) {
+	peer := &clusterPeer{}
+	for i := 0; i < peerBreakerMaxFailures-1; i++ {
+		peer.recordDialResult(errors.New("dial failed"))
+	}
+	if !peer.isHealthy() {
+		t.Fatalf("a peer with fewer than %d consecutive failures should still be healthy", peerBreakerMaxFailures)
+	}
+	if peer.consecutiveFailures != peerBreakerMaxFailures-1 {
+		t.Fatalf("consecutiveFailures = %d, want %d", peer.consecutiveFailures, peerBreakerMaxFailures-1)
+	}
+}
+
+func TestRecordDialResultSuccessResetsCounter(t *testing.T) {
+	peer := &clusterPeer{}
+	peer.recordDialResult(errors.New("dial failed"))
+	peer.recordDialResult(errors.New("dial failed"))
+	peer.recordDialResult(nil)
+
+	if peer.consecutiveFailures != 0 {
+		t.Fatalf("consecutiveFailures = %d after a success, want 0", peer.consecutiveFailures)
+	}
+	if !peer.unhealthyUntil.IsZero() {
+		t.Fatalf("unhealthyUntil should be cleared by a success")
+	}
+	if !peer.isHealthy() {
+		t.Fatalf("a peer should be healthy right after a successful dial")
+	}
+}
+
+func TestRecordDialResultResetsAfterWindowExpires(t *testing.T) {
+	peer := &clusterPeer{}
+	peer.recordDialResult(errors.New("dial failed"))
+	peer.recordDialResult(errors.New("dial failed"))
+
+	// Simulate the failure window having elapsed since the first failure
+	// in this run; the next failure should start a fresh window rather
+	// than accumulate towards the breaker.
+	peer.failureWindowStart = time.Now().Add(-peerBreakerWindow - time.Second)
+	peer.recordDialResult(errors.New("dial failed"))
+
+	if peer.consecutiveFailures != 1 {
+		t.Fatalf("consecutiveFailures = %d after the window expired, want 1", peer.consecutiveFailures)
+	}
+	if !peer.isHealthy() {
+		t.Fatalf("a peer below the breaker threshold should still be healthy")
+	}
+}
+
+func TestClusterPeerWeight(t *testing.T) {
+	peer := &clusterPeer{}
+	if w := peer.getWeight(); w != 1 {
+		t.Fatalf("default weight = %d, want 1", w)
+	}
+
+	peer.SetWeight(5)
+	if w := peer.getWeight(); w != 5 {
+		t.Fatalf("weight after SetWeight(5) = %d, want 5", w)
+	}
+
+	peer.SetWeight(0)
+	if w := peer.getWeight(); w != 1 {
+		t.Fatalf("weight after SetWeight(0) = %d, want the floor of 1", w)
+	}
+}
+
+func TestClusterPeerOutstandingConns(t *testing.T) {
+	peer := &clusterPeer{outstanding: 3}
+	if got := peer.outstandingConns(); got != 3 {
+		t.Fatalf("outstandingConns() = %d, want 3", got)
+	}
+}
+
+func TestRemovePeerFromSlice(t *testing.T) {
+	a, b, c := &clusterPeer{}, &clusterPeer{}, &clusterPeer{}
+	peers := []*clusterPeer{a, b, c}
+
+	remaining := removePeerFromSlice(peers, b)
+	if len(remaining) != 2 || remaining[0] != a || remaining[1] != c {
+		t.Fatalf("removePeerFromSlice(%v, b) = %v, want [a c]", peers, remaining)
+	}
+
+	remaining = removePeerFromSlice(peers, &clusterPeer{})
+	if len(remaining) != 3 {
+		t.Fatalf("removePeerFromSlice with a peer not present should leave every peer, got %v", remaining)
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClusterPeerTransport selects the on-the-wire transport clusterPeer.Dial
+// uses for the proxy: subsystem hop to a peer proxy.
+type ClusterPeerTransport string
+
+const (
+	// ClusterPeerTransportSSHSubsystem tunnels raw bytes through the
+	// proxy:<addr>@<cluster> SSH subsystem's stdin/stdout. This is the
+	// original transport and remains the default.
+	ClusterPeerTransportSSHSubsystem ClusterPeerTransport = "ssh-subsystem"
+
+	// ClusterPeerTransportTLS wraps the same byte stream in mTLS,
+	// authenticated against the trusted cluster CA, giving the hop its
+	// own encrypted channel independent of the outer SSH session's
+	// crypto.
+	ClusterPeerTransportTLS ClusterPeerTransport = "tls"
+
+	// clusterPeerTLSHandshakeTimeout bounds how long
+	// ClusterPeerTLSHandler.handleConn waits for a client to complete
+	// the TLS handshake and send its proxy:<addr>@<cluster> preamble,
+	// so a connection that never does either can't hold a handler
+	// goroutine open indefinitely.
+	clusterPeerTLSHandshakeTimeout = defaults.DefaultDialTimeout
+)
+
+// ClusterPeerConfig configures how a clusterPeer reaches its peer proxy.
+// The zero value uses ClusterPeerTransportSSHSubsystem.
+type ClusterPeerConfig struct {
+	// Transport selects the transport for the proxy: hop.
+	Transport ClusterPeerTransport
+
+	// TLS configures ClusterPeerTransportTLS. Required when Transport is
+	// ClusterPeerTransportTLS.
+	TLS *ClusterPeerTLSConfig
+}
+
+// ClusterPeerTLSConfig configures the TLS transport, on both the dialing
+// and the accepting side.
+type ClusterPeerTLSConfig struct {
+	// GetCertificate returns the host certificate/key pair this proxy
+	// presents during the handshake.
+	GetCertificate func() (*tls.Certificate, error)
+
+	// CAPool holds the trusted cluster CA(s) used to verify the peer's
+	// certificate, as a client verifying the server and as a server
+	// verifying the client.
+	CAPool *x509.CertPool
+
+	// CipherSuites restricts the negotiated cipher suites. A nil value
+	// uses the Go standard library defaults.
+	CipherSuites []uint16
+
+	// MinVersion is the minimum accepted TLS version. Defaults to
+	// tls.VersionTLS12.
+	MinVersion uint16
+}
+
+// verifyChainsToCAPool returns a tls.Config.VerifyPeerCertificate callback
+// that accepts the peer's certificate if it chains to a trusted CA in
+// pool, independent of any hostname/SNI. It's used in place of the
+// standard library's hostname-based verification because ServerName here
+// carries the target cluster name (for SNI routing), not the peer
+// proxy's own identity, so matching the cert against it would reject
+// every otherwise-valid peer.
+func verifyChainsToCAPool(pool *x509.CertPool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return trace.AccessDenied("peer presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		intermediates := x509.NewCertPool()
+		for _, raw := range rawCerts[1:] {
+			intermediate, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			intermediates.AddCert(intermediate)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		return trace.Wrap(err)
+	}
+}
+
+func (c *ClusterPeerTLSConfig) minVersion() uint16 {
+	if c.MinVersion == 0 {
+		return tls.VersionTLS12
+	}
+	return c.MinVersion
+}
+
+// clientConfig builds the tls.Config used to dial a peer proxy for
+// cluster clusterName. ServerName carries the cluster name as SNI so a
+// single TLS listener on the peer can front many clusters - it does not
+// identify the peer itself, so the standard library's ServerName-based
+// VerifyHostname is disabled in favor of VerifyPeerCertificate, which
+// checks the peer's certificate chains to the trusted cluster CA without
+// regard to hostname.
+func (c *ClusterPeerTLSConfig) clientConfig(clusterName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:            clusterName,
+		CipherSuites:          c.CipherSuites,
+		MinVersion:            c.minVersion(),
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyChainsToCAPool(c.CAPool),
+	}
+	if c.GetCertificate != nil {
+		cert, err := c.GetCertificate()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config, nil
+}
+
+// serverConfig builds the tls.Config a ClusterPeerTLSHandler uses to
+// accept connections for one cluster.
+func (c *ClusterPeerTLSConfig) serverConfig() (*tls.Config, error) {
+	if c.GetCertificate == nil {
+		return nil, trace.BadParameter("ClusterPeerTLSConfig.GetCertificate is required to serve the TLS transport")
+	}
+	cert, err := c.GetCertificate()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    c.CAPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		CipherSuites: c.CipherSuites,
+		MinVersion:   c.minVersion(),
+	}, nil
+}
+
+// dialTLS is the ClusterPeerTransportTLS counterpart to dialSSHSubsystem:
+// it opens a raw connection to the peer proxy's TLS listener, wraps it in
+// mTLS (verifying the peer's host certificate against the trusted
+// cluster CA, with SNI set to the target cluster), and sends the same
+// proxy:<addr>@<cluster> framing the ssh-subsystem transport uses so the
+// peer's ClusterPeerTLSHandler knows where to forward the stream.
+func (s *clusterPeer) dialTLS(from, to net.Addr) (net.Conn, error) {
+	if s.config.TLS == nil {
+		return nil, trace.BadParameter("cluster peer transport is %q but ClusterPeerConfig.TLS is not set", ClusterPeerTransportTLS)
+	}
+
+	s.log.Infof("[TUNNEL] forward connection to %v through the peer %v over TLS", to, s.connInfo.GetProxyAddr())
+
+	rawConn, err := net.DialTimeout(to.Network(), s.connInfo.GetProxyAddr(), defaults.DefaultDialTimeout)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConfig, err := s.config.TLS.clientConfig(s.connInfo.GetClusterName())
+	if err != nil {
+		rawConn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	if _, err := fmt.Fprintf(tlsConn, "proxy:%v@%v\n", to, s.connInfo.GetClusterName()); err != nil {
+		tlsConn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	return utils.NewPipeNetConn(tlsConn, tlsConn, tlsConn, from, to), nil
+}
+
+// ClusterPeerTLSRoute is one cluster's share of a ClusterPeerTLSHandler:
+// the TLS policy used to authenticate its peers, and where to forward a
+// verified connection's requested destination.
+type ClusterPeerTLSRoute struct {
+	// TLS authenticates peers for this cluster.
+	TLS *ClusterPeerTLSConfig
+	// Dial connects to the destination named in a connection's preamble.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// ClusterPeerTLSHandler is the server side of ClusterPeerTransportTLS: a
+// single listener that accepts TLS connections from peer proxies across
+// any number of clusters, selecting each connection's CA pool and
+// certificate by SNI before verifying the client and forwarding the
+// stream to the destination named in its proxy:<addr>@<cluster> preamble.
+type ClusterPeerTLSHandler struct {
+	// Clusters maps cluster name (as carried by SNI) to that cluster's
+	// route.
+	Clusters map[string]*ClusterPeerTLSRoute
+
+	log *log.Entry
+}
+
+// NewClusterPeerTLSHandler returns a handler for the given cluster
+// routes.
+func NewClusterPeerTLSHandler(clusters map[string]*ClusterPeerTLSRoute) *ClusterPeerTLSHandler {
+	return &ClusterPeerTLSHandler{
+		Clusters: clusters,
+		log: log.WithFields(log.Fields{
+			teleport.Component: teleport.ComponentReverseTunnel,
+			teleport.ComponentFields: map[string]string{
+				"side":      "server",
+				"transport": "tls",
+			},
+		}),
+	}
+}
+
+// Serve accepts TLS connections from listener, handling each one in its
+// own goroutine, until listener is closed or Accept otherwise errors.
+func (h *ClusterPeerTLSHandler) Serve(listener net.Listener) error {
+	tlsListener := tls.NewListener(listener, &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			route, ok := h.Clusters[hello.ServerName]
+			if !ok {
+				return nil, trace.NotFound("no TLS route configured for cluster %q", hello.ServerName)
+			}
+			return route.TLS.serverConfig()
+		},
+	})
+	for {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		go h.handleConn(conn)
+	}
+}
+
+func (h *ClusterPeerTLSHandler) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	// Bound the handshake and preamble read so a connection that never
+	// completes either (with or without a valid client cert) can't hold
+	// this goroutine open forever; it's cleared once the stream starts
+	// being forwarded below.
+	if err := conn.SetDeadline(time.Now().Add(clusterPeerTLSHandshakeTimeout)); err != nil {
+		h.log.Warningf("[TUNNEL] failed to set handshake deadline for %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		h.log.Warningf("[TUNNEL] expected *tls.Conn, got %T", conn)
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		h.log.Warningf("[TUNNEL] TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	clusterName := tlsConn.ConnectionState().ServerName
+	route, ok := h.Clusters[clusterName]
+	if !ok {
+		h.log.Warningf("[TUNNEL] rejecting TLS connection for unknown cluster %q", clusterName)
+		return
+	}
+
+	reader := bufio.NewReader(tlsConn)
+	preamble, err := reader.ReadString('\n')
+	if err != nil {
+		h.log.Warningf("[TUNNEL] failed to read proxy: preamble over TLS: %v", err)
+		return
+	}
+
+	target, preambleCluster, err := parseProxySubsystemName(strings.TrimSpace(preamble))
+	if err != nil {
+		h.log.Warningf("[TUNNEL] %v", err)
+		return
+	}
+	if preambleCluster != clusterName {
+		h.log.Warningf("[TUNNEL] rejecting TLS connection: SNI cluster %q does not match preamble cluster %q", clusterName, preambleCluster)
+		return
+	}
+
+	// The preamble is in; lift the deadline before forwarding, which can
+	// legitimately run for the life of a long session.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		h.log.Warningf("[TUNNEL] failed to clear deadline for %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	remote, err := route.Dial("tcp", target)
+	if err != nil {
+		h.log.Warningf("[TUNNEL] failed to dial %v for cluster %v: %v", target, clusterName, err)
+		return
+	}
+	defer remote.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(remote, reader)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(tlsConn, remote)
+		errCh <- err
+	}()
+	<-errCh
+}
+
+// parseProxySubsystemName splits the "proxy:<addr>@<cluster>" framing
+// shared by both the ssh-subsystem and TLS transports into its address
+// and cluster name parts.
+func parseProxySubsystemName(name string) (addr string, clusterName string, err error) {
+	const prefix = "proxy:"
+	if !strings.HasPrefix(name, prefix) {
+		return "", "", trace.BadParameter("invalid proxy subsystem name %q", name)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, prefix), "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", trace.BadParameter("invalid proxy subsystem name %q", name)
+	}
+	return parts[0], parts[1], nil
+}
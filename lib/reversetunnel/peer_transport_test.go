@@ -0,0 +1,175 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseProxySubsystemName(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		addr        string
+		clusterName string
+		wantErr     bool
+	}{
+		{name: "valid", input: "proxy:127.0.0.1:3022@leaf", addr: "127.0.0.1:3022", clusterName: "leaf"},
+		{name: "no prefix", input: "127.0.0.1:3022@leaf", wantErr: true},
+		{name: "no at sign", input: "proxy:127.0.0.1:3022", wantErr: true},
+		{name: "empty addr", input: "proxy:@leaf", wantErr: true},
+		{name: "empty cluster", input: "proxy:127.0.0.1:3022@", wantErr: true},
+		{name: "empty string", input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, clusterName, err := parseProxySubsystemName(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseProxySubsystemName(%q) = nil error, want one", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseProxySubsystemName(%q) returned an unexpected error: %v", tt.input, err)
+			}
+			if addr != tt.addr || clusterName != tt.clusterName {
+				t.Fatalf("parseProxySubsystemName(%q) = (%q, %q), want (%q, %q)",
+					tt.input, addr, clusterName, tt.addr, tt.clusterName)
+			}
+		})
+	}
+}
+
+// selfSignedCert generates a minimal self-signed certificate for cn,
+// signed by itself, for use as either a trusted CA or a leaf to verify.
+func selfSignedCert(t *testing.T, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// certSignedBy generates a leaf certificate for cn, signed by caKey/caCert.
+func certSignedBy(t *testing.T, cn string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestVerifyChainsToCAPoolAcceptsTrustedCert(t *testing.T) {
+	caCert, caKey := selfSignedCert(t, "cluster-ca")
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	leaf := certSignedBy(t, "peer-proxy", caCert, caKey)
+
+	verify := verifyChainsToCAPool(pool)
+	if err := verify([][]byte{leaf.Raw}, nil); err != nil {
+		t.Fatalf("verifyChainsToCAPool rejected a certificate signed by a trusted CA: %v", err)
+	}
+}
+
+func TestVerifyChainsToCAPoolRejectsUntrustedCert(t *testing.T) {
+	trustedCA, _ := selfSignedCert(t, "cluster-ca")
+	otherCA, otherKey := selfSignedCert(t, "other-ca")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(trustedCA)
+
+	leaf := certSignedBy(t, "peer-proxy", otherCA, otherKey)
+
+	verify := verifyChainsToCAPool(pool)
+	if err := verify([][]byte{leaf.Raw}, nil); err == nil {
+		t.Fatalf("verifyChainsToCAPool accepted a certificate from an untrusted CA")
+	}
+}
+
+func TestVerifyChainsToCAPoolRejectsNoCertificate(t *testing.T) {
+	pool := x509.NewCertPool()
+	verify := verifyChainsToCAPool(pool)
+	if err := verify(nil, nil); err == nil {
+		t.Fatalf("verifyChainsToCAPool accepted an empty certificate chain")
+	}
+}
+
+func TestClusterPeerTLSConfigMinVersion(t *testing.T) {
+	c := &ClusterPeerTLSConfig{}
+	if got, want := c.minVersion(), uint16(tls.VersionTLS12); got != want {
+		t.Fatalf("default minVersion() = %#x, want %#x", got, want)
+	}
+
+	c.MinVersion = tls.VersionTLS13
+	if got := c.minVersion(); got != c.MinVersion {
+		t.Fatalf("minVersion() = %#x, want the explicitly configured %#x", got, c.MinVersion)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// compareSemver compares two "major.minor.patch"-style version strings
+// (an optional leading "v" and any "-pre"/"+build" suffix are ignored)
+// and returns -1, 0, or 1 as a is less than, equal to, or greater than b.
+func compareSemver(a, b string) (int, error) {
+	av, err := parseSemver(a)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	bv, err := parseSemver(b)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	for i := range av {
+		if av[i] != bv[i] {
+			if av[i] < bv[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// parseSemver parses the major.minor.patch components out of a version
+// string, ignoring a leading "v" and any "-"/"+" suffix.
+func parseSemver(version string) ([3]int, error) {
+	var out [3]int
+
+	version = strings.TrimPrefix(version, "v")
+	version = strings.SplitN(version, "-", 2)[0]
+	version = strings.SplitN(version, "+", 2)[0]
+
+	fields := strings.Split(version, ".")
+	if len(fields) == 0 || fields[0] == "" {
+		return out, trace.BadParameter("invalid version %q", version)
+	}
+	for i := 0; i < len(fields) && i < len(out); i++ {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return out, trace.BadParameter("invalid version %q: %v", version, err)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
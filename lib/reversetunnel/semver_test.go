@@ -0,0 +1,90 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+*/
+
+package reversetunnel
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		wantErr bool
+	}{
+		{version: "2.3.0", want: [3]int{2, 3, 0}},
+		{version: "v2.3.0", want: [3]int{2, 3, 0}},
+		{version: "2.3.0-pre.1", want: [3]int{2, 3, 0}},
+		{version: "2.3.0+build5", want: [3]int{2, 3, 0}},
+		{version: "3", want: [3]int{3, 0, 0}},
+		{version: "3.1", want: [3]int{3, 1, 0}},
+		{version: "", wantErr: true},
+		{version: "not-a-version", wantErr: true},
+		{version: "2.x.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSemver(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSemver(%q) = nil error, want one", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSemver(%q) returned an unexpected error: %v", tt.version, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSemver(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "2.3.0", b: "2.3.0", want: 0},
+		{a: "2.3.1", b: "2.3.0", want: 1},
+		{a: "2.3.0", b: "2.3.1", want: -1},
+		{a: "3.0.0", b: "2.9.9", want: 1},
+		{a: "2.9.9", b: "3.0.0", want: -1},
+		{a: "v2.3.0", b: "2.3.0", want: 0},
+		{a: "2.3.0-pre.1", b: "2.3.0", want: 0},
+	}
+
+	for _, tt := range tests {
+		got, err := compareSemver(tt.a, tt.b)
+		if err != nil {
+			t.Errorf("compareSemver(%q, %q) returned an unexpected error: %v", tt.a, tt.b, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("compareSemver(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareSemverInvalidVersion(t *testing.T) {
+	if _, err := compareSemver("bogus", "2.3.0"); err == nil {
+		t.Fatalf("compareSemver with an invalid version should return an error")
+	}
+	if _, err := compareSemver("2.3.0", "bogus"); err == nil {
+		t.Fatalf("compareSemver with an invalid version should return an error")
+	}
+}